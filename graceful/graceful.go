@@ -0,0 +1,180 @@
+// Package graceful wraps an http.Server with graceful
+// shutdown and zero-downtime SIGHUP restart, handing
+// the listening socket off to a freshly spawned child
+// process in a way that is compatible with systemd
+// socket activation (LISTEN_FDS).
+package graceful
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// envListenFDs is set in the child's environment to
+// signal that fd 'listenFD' is an inherited listener
+// rather than one that should be freshly opened.
+const envListenFDs = "LISTEN_FDS"
+
+// listenFD is the file descriptor the inherited
+// listener is passed on, following the systemd
+// socket-activation convention (0, 1, 2 are stdio).
+const listenFD = 3
+
+// Server wraps an *http.Server, adding a hammer
+// timeout for draining in-flight requests and hooks
+// that run around shutdown and restart.
+type Server struct {
+	inner         httpServer
+	hammerTimeout time.Duration
+	listener      net.Listener
+
+	preShutdown []func()
+	postRestart []func()
+}
+
+// httpServer is the subset of *http.Server that Server
+// needs, so tests can supply a fake.
+type httpServer interface {
+	Serve(ln net.Listener) error
+	Shutdown(ctx context.Context) error
+	Close() error
+}
+
+// NewServer wraps inner, forcibly closing any
+// connections still open hammerTimeout after a
+// shutdown or restart has been requested.
+func NewServer(inner httpServer, hammerTimeout time.Duration) *Server {
+	return &Server{inner: inner, hammerTimeout: hammerTimeout}
+}
+
+// OnPreShutdown registers fn to run before the server
+// starts draining connections, e.g. to persist state
+// that must survive a restart.
+func (s *Server) OnPreShutdown(fn func()) {
+	s.preShutdown = append(s.preShutdown, fn)
+}
+
+// OnPostRestart registers fn to run in the child
+// process, once it has taken over the inherited
+// listener and is about to start accepting.
+func (s *Server) OnPostRestart(fn func()) {
+	s.postRestart = append(s.postRestart, fn)
+}
+
+// ListenAndServe listens on addr, or resumes accepting
+// on a listener inherited via LISTEN_FDS if this
+// process was spawned by Restart, and serves until
+// Shutdown is called.
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := s.listen(addr)
+	if err != nil {
+		return err
+	}
+	s.listener = ln
+
+	return s.inner.Serve(ln)
+}
+
+// listen returns the inherited listener, when this
+// process was spawned as part of a restart, or opens
+// a fresh one on addr otherwise.
+func (s *Server) listen(addr string) (net.Listener, error) {
+	if os.Getenv(envListenFDs) == "" {
+		return net.Listen("tcp", addr)
+	}
+
+	f := os.NewFile(listenFD, "listener")
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("graceful: inherit listener: %v", err)
+	}
+	f.Close()
+
+	for _, fn := range s.postRestart {
+		fn()
+	}
+
+	return ln, nil
+}
+
+// Shutdown runs the pre-shutdown hooks, then drains
+// in-flight connections, forcibly closing whatever is
+// left once hammerTimeout elapses.
+func (s *Server) Shutdown() error {
+	s.runPreShutdown()
+	return s.drain()
+}
+
+// runPreShutdown runs the registered pre-shutdown hooks,
+// e.g. to persist state that must survive a restart.
+func (s *Server) runPreShutdown() {
+	for _, fn := range s.preShutdown {
+		fn()
+	}
+}
+
+// drain waits up to hammerTimeout for in-flight requests
+// to finish on their own, then hammers the listener
+// closed, forcibly dropping whatever connections are
+// still open.
+func (s *Server) drain() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.hammerTimeout)
+	defer cancel()
+
+	err := s.inner.Shutdown(ctx)
+	if err == context.DeadlineExceeded {
+		if closeErr := s.inner.Close(); closeErr != nil {
+			return closeErr
+		}
+	}
+	return err
+}
+
+// Restart spawns a copy of the running binary, handing
+// it the listening socket via ExtraFiles so it can
+// resume accepting with no dropped connections, then
+// drains and shuts down the current process' server.
+//
+// The pre-shutdown hooks run before the child is spawned,
+// so state the child's post-restart hooks depend on (e.g.
+// persisted counters) is durably written before the child
+// can possibly read it back.
+//
+// Restart can only hand off a *net.TCPListener; it
+// returns an error if ListenAndServe has not been
+// called yet, or the configured listener does not
+// support duplicating its file descriptor.
+func (s *Server) Restart() error {
+	if s.listener == nil {
+		return fmt.Errorf("graceful: Restart called before ListenAndServe")
+	}
+
+	tcpLn, ok := s.listener.(*net.TCPListener)
+	if !ok {
+		return fmt.Errorf("graceful: listener of type %T does not support handoff", s.listener)
+	}
+
+	lnFile, err := tcpLn.File()
+	if err != nil {
+		return fmt.Errorf("graceful: duplicate listener fd: %v", err)
+	}
+	defer lnFile.Close()
+
+	s.runPreShutdown()
+
+	child := exec.Command(os.Args[0], os.Args[1:]...)
+	child.Stdout = os.Stdout
+	child.Stderr = os.Stderr
+	child.ExtraFiles = []*os.File{lnFile}
+	child.Env = append(os.Environ(), envListenFDs+"=1")
+
+	if err := child.Start(); err != nil {
+		return fmt.Errorf("graceful: spawn child: %v", err)
+	}
+
+	return s.drain()
+}
@@ -0,0 +1,209 @@
+// Package metrics is a small Prometheus-compatible
+// metrics subsystem: a request counter and a latency
+// histogram, both labelled by route, and an unlabelled
+// in-flight gauge, exposed in Prometheus text
+// exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/luigi-riefolo/simple_server/router"
+)
+
+// DefaultBuckets are the latency histogram bucket
+// upper bounds, in seconds, used when a Registry is
+// created with a nil bucket list.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// routeStatus labels a request total by the route it
+// matched and the status code it was served with.
+type routeStatus struct {
+	route  string
+	status int
+}
+
+// histogram is a cumulative latency histogram for a
+// single route, guarded by its Registry's mutex.
+type histogram struct {
+	buckets    []float64
+	counts     []uint64
+	sumSeconds float64
+	count      uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+// observe folds an observation of v seconds into the
+// histogram; each bucket count is cumulative, i.e. it
+// counts every observation less than or equal to its
+// upper bound, matching Prometheus' exposition format.
+func (h *histogram) observe(v float64) {
+	h.count++
+	h.sumSeconds += v
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+}
+
+// Registry collects request totals, an in-flight
+// gauge and per-route latency histograms.
+type Registry struct {
+	mu        sync.Mutex
+	buckets   []float64
+	totals    map[routeStatus]uint64
+	latencies map[string]*histogram
+	inFlight  int64
+}
+
+// NewRegistry returns an empty Registry. A nil or
+// empty buckets slice falls back to DefaultBuckets.
+func NewRegistry(buckets []float64) *Registry {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	return &Registry{
+		buckets:   buckets,
+		totals:    map[routeStatus]uint64{},
+		latencies: map[string]*histogram{},
+	}
+}
+
+// IncInFlight increments the in-flight request gauge.
+func (r *Registry) IncInFlight() { atomic.AddInt64(&r.inFlight, 1) }
+
+// DecInFlight decrements the in-flight request gauge.
+func (r *Registry) DecInFlight() { atomic.AddInt64(&r.inFlight, -1) }
+
+// observe records one completed request for route,
+// served with the given status after d.
+func (r *Registry) observe(route string, status int, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.totals[routeStatus{route: route, status: status}]++
+
+	h, ok := r.latencies[route]
+	if !ok {
+		h = newHistogram(r.buckets)
+		r.latencies[route] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// RequestsByRoute returns the total request count
+// served so far, summed across status codes, per
+// route.
+func (r *Registry) RequestsByRoute() map[string]uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := make(map[string]uint64, len(r.latencies))
+	for rs, n := range r.totals {
+		out[rs.route] += n
+	}
+	return out
+}
+
+// statusWriter wraps an http.ResponseWriter, capturing
+// the status code passed to WriteHeader.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Middleware times every request that passes through
+// it, records its status and latency against reg under
+// the route name assigned by router.RouteName, and
+// tracks how many requests are in flight. onRequest, if
+// not nil, is called once per request, before its
+// handler runs, with its route name, so callers can
+// feed other subsystems (e.g. a sliding-window counter)
+// from the exact same measurement point used for
+// /metrics.
+func Middleware(reg *Registry, onRequest func(route string, r *http.Request)) router.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reg.IncInFlight()
+			defer reg.DecInFlight()
+
+			route := router.RouteName(r)
+			if route == "" {
+				route = r.URL.Path
+			}
+			if onRequest != nil {
+				onRequest(route, r)
+			}
+
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			start := time.Now()
+			next.ServeHTTP(sw, r)
+			elapsed := time.Since(start)
+
+			reg.observe(route, sw.status, elapsed)
+		})
+	}
+}
+
+// WritePrometheus writes every metric in r in
+// Prometheus text exposition format.
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP http_requests_total Total number of HTTP requests.")
+	fmt.Fprintln(w, "# TYPE http_requests_total counter")
+	keys := make([]routeStatus, 0, len(r.totals))
+	for k := range r.totals {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].status < keys[j].status
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "http_requests_total{route=%q,status=\"%d\"} %d\n", k.route, k.status, r.totals[k])
+	}
+
+	fmt.Fprintln(w, "# HELP http_in_flight_requests Number of requests currently being served.")
+	fmt.Fprintln(w, "# TYPE http_in_flight_requests gauge")
+	fmt.Fprintf(w, "http_in_flight_requests %d\n", atomic.LoadInt64(&r.inFlight))
+
+	fmt.Fprintln(w, "# HELP http_request_duration_seconds Latency of HTTP requests.")
+	fmt.Fprintln(w, "# TYPE http_request_duration_seconds histogram")
+	routes := make([]string, 0, len(r.latencies))
+	for route := range r.latencies {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		h := r.latencies[route]
+		for i, bound := range h.buckets {
+			le := strconv.FormatFloat(bound, 'g', -1, 64)
+			fmt.Fprintf(w, "http_request_duration_seconds_bucket{route=%q,le=%q} %d\n", route, le, h.counts[i])
+		}
+		fmt.Fprintf(w, "http_request_duration_seconds_bucket{route=%q,le=\"+Inf\"} %d\n", route, h.count)
+		fmt.Fprintf(w, "http_request_duration_seconds_sum{route=%q} %s\n", route, strconv.FormatFloat(h.sumSeconds, 'f', -1, 64))
+		fmt.Fprintf(w, "http_request_duration_seconds_count{route=%q} %d\n", route, h.count)
+	}
+
+	return nil
+}
@@ -0,0 +1,212 @@
+// Package router provides a small trie-based HTTP
+// request multiplexer supporting path parameters,
+// per-route method restrictions and middleware
+// chaining, so that a server built on it can be used
+// as a library rather than a single-purpose binary.
+package router
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+)
+
+// Middleware wraps a handler to produce another,
+// e.g. for logging, auth or metrics. A Middleware can
+// recover the pattern a request matched via RouteName,
+// to label per-route statistics.
+type Middleware func(http.Handler) http.Handler
+
+// Server is an http.Handler that dispatches to
+// handlers registered with Handle/HandleFunc, in
+// front of a chain of middleware.
+type Server struct {
+	root       *node
+	middleware []Middleware
+}
+
+// NewServer returns an empty Server ready to have
+// routes registered on it.
+func NewServer() *Server {
+	return &Server{root: &node{children: map[string]*node{}}}
+}
+
+// Use appends mw to the middleware chain, which wraps
+// every request in registration order (the first
+// Middleware passed to Use runs outermost).
+func (s *Server) Use(mw ...Middleware) {
+	s.middleware = append(s.middleware, mw...)
+}
+
+// Handle registers h for pattern, restricted to
+// methods if any are given, or to every method
+// otherwise. pattern segments prefixed with ':' bind
+// as path parameters, retrievable via Param.
+func (s *Server) Handle(pattern string, h http.Handler, methods ...string) {
+	s.root.insert(pattern, route{pattern: pattern, methods: methodSet(methods), handler: h})
+}
+
+// HandleFunc registers f as the handler for pattern,
+// see Handle.
+func (s *Server) HandleFunc(pattern string, f func(http.ResponseWriter, *http.Request), methods ...string) {
+	s.Handle(pattern, http.HandlerFunc(f), methods...)
+}
+
+// ServeHTTP resolves the registered route for the
+// request, enforces its allowed methods, and invokes
+// its handler through the middleware chain.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt, params, ok := s.root.match(r.URL.Path)
+	if !ok {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Requested resource '%s' does not exist\n",
+			html.EscapeString(r.URL.Path))
+		return
+	}
+
+	if len(rt.methods) > 0 && !rt.methods[r.Method] {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), routeKey{}, rt.pattern)
+	if len(params) > 0 {
+		ctx = context.WithValue(ctx, paramsKey{}, params)
+	}
+	r = r.WithContext(ctx)
+
+	s.chain(rt.handler).ServeHTTP(w, r)
+}
+
+// chain wraps h with the registered middleware, in
+// the order Use was called.
+func (s *Server) chain(h http.Handler) http.Handler {
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		h = s.middleware[i](h)
+	}
+	return h
+}
+
+// methodSet builds a lookup set from a list of HTTP
+// methods; a nil/empty list means "any method".
+func methodSet(methods []string) map[string]bool {
+	if len(methods) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(methods))
+	for _, m := range methods {
+		set[m] = true
+	}
+	return set
+}
+
+// route pairs a registered pattern with its allowed
+// methods and handler.
+type route struct {
+	pattern string
+	methods map[string]bool
+	handler http.Handler
+}
+
+// node is a single segment of the route trie. Static
+// children are looked up by segment text; a single
+// param child, if present, matches any segment and
+// binds it under its own name.
+type node struct {
+	children map[string]*node
+	param    *node
+	paramKey string
+	route    *route
+}
+
+// paramsKey is the context key path parameters are
+// stored under.
+type paramsKey struct{}
+
+// routeKey is the context key the matched pattern is
+// stored under.
+type routeKey struct{}
+
+// Param returns the value bound to name by the route
+// that matched r, or "" if there is no such parameter.
+func Param(r *http.Request, name string) string {
+	params, _ := r.Context().Value(paramsKey{}).(map[string]string)
+	return params[name]
+}
+
+// RouteName returns the pattern the route that matched
+// r was registered under, or "" if r was not served
+// through a Server.
+func RouteName(r *http.Request) string {
+	name, _ := r.Context().Value(routeKey{}).(string)
+	return name
+}
+
+// insert adds rt to the trie under pattern.
+func (n *node) insert(pattern string, rt route) {
+	segments := splitPath(pattern)
+	cur := n
+	for _, seg := range segments {
+		if strings.HasPrefix(seg, ":") {
+			if cur.param == nil {
+				cur.param = &node{children: map[string]*node{}, paramKey: seg[1:]}
+			}
+			cur = cur.param
+			continue
+		}
+
+		child, ok := cur.children[seg]
+		if !ok {
+			child = &node{children: map[string]*node{}}
+			cur.children[seg] = child
+		}
+		cur = child
+	}
+	rtCopy := rt
+	cur.route = &rtCopy
+}
+
+// match walks the trie for path, returning the
+// registered route and any bound path parameters.
+func (n *node) match(path string) (route, map[string]string, bool) {
+	segments := splitPath(path)
+	cur := n
+	var params map[string]string
+
+	for _, seg := range segments {
+		if child, ok := cur.children[seg]; ok {
+			cur = child
+			continue
+		}
+		if cur.param != nil {
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[cur.param.paramKey] = seg
+			cur = cur.param
+			continue
+		}
+		return route{}, nil, false
+	}
+
+	if cur.route == nil {
+		return route{}, nil, false
+	}
+	return *cur.route, params, true
+}
+
+// splitPath splits a URL path into its non-empty
+// segments, so "/" and "" both yield no segments.
+func splitPath(path string) []string {
+	parts := strings.Split(path, "/")
+	segments := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p != "" {
+			segments = append(segments, p)
+		}
+	}
+	return segments
+}
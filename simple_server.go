@@ -4,241 +4,703 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
-	"html"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/luigi-riefolo/simple_server/graceful"
+	"github.com/luigi-riefolo/simple_server/metrics"
+	"github.com/luigi-riefolo/simple_server/persist"
+	"github.com/luigi-riefolo/simple_server/router"
+	"github.com/luigi-riefolo/simple_server/stream"
 )
 
 const (
 	connPort    = ":8080"
 	requestFile = "request-file.txt"
-	// Time period for each
-	// counter request increment.
-	timeLapse = time.Second
-	// Request counter time window.
-	timeWindow = time.Minute
+	// Default window/resolution pairs, used when
+	// '-windows' is not supplied on the command line.
+	defaultWindows = "1m:1s,5m:5s,15m:15s,1h:1m"
+	// Duration of the window used by the root handler
+	// to report the legacy "Served N requests" line.
+	// Keyed on the parsed duration, not its string
+	// spelling, so "-windows 60s:1s,..." still matches
+	// it the same as the default "1m:1s,...".
+	primaryWindowDuration = time.Minute
+	// Route whose requests feed the primaryWindowDuration
+	// counter.
+	primaryWindowRoute = "/"
+	// Default time allowed for in-flight requests to
+	// drain before connections are forcibly closed.
+	defaultShutdownTimeout = 10 * time.Second
+	// Default cap on the body of a streamed request,
+	// in bytes.
+	defaultMaxRequestBytes = 64 << 20 // 64MiB
+	// Default interval at which counter state is
+	// flushed to disk, decoupled from the tick
+	// resolution so counters can tick at 1s while
+	// flushes happen far less often.
+	defaultPersistInterval = 10 * time.Second
+	// Default interval at which the append-only log
+	// backend is compacted down to its latest entry.
+	defaultCompactInterval = 5 * time.Minute
+	// Number of times save() attempts to persist state,
+	// counting the first try, before giving up and logging.
+	maxPersistAttempts = 3
+	// Delay between persist retries.
+	persistRetryBackoff = 500 * time.Millisecond
 )
 
-// requestCounter keeps track of the number of
-// requests received in a 'timeWindow' period.
+// windows holds the operator-configured set of
+// "duration:resolution" pairs, e.g. "5m:5s,1h:1m".
+var windows = flag.String("windows", defaultWindows,
+	"comma-separated list of duration:resolution window pairs, e.g. 1m:1s,1h:1m")
+
+// shutdownTimeout bounds how long a graceful shutdown
+// or restart waits for in-flight requests to drain
+// before hammering remaining connections closed.
+var shutdownTimeout = flag.Duration("shutdown-timeout", defaultShutdownTimeout,
+	"time allowed for in-flight requests to drain before forcibly closing connections")
+
+// maxRequestBytes caps how many body bytes a streamed
+// request is allowed to carry, to bound memory use
+// regardless of how many records it contains.
+var maxRequestBytes = flag.Int64("max-request-bytes", defaultMaxRequestBytes,
+	"maximum body size, in bytes, accepted by streaming routes")
+
+// persistBackend selects the Persister implementation
+// the counter's state is saved to.
+var persistBackend = flag.String("persist-backend", "file",
+	"counter persistence backend: file or appendlog")
+
+// persistInterval bounds how often counter state is
+// flushed to disk, independent of the tick resolution.
+var persistInterval = flag.Duration("persist-interval", defaultPersistInterval,
+	"how often counter state is flushed to disk")
+
+// compactInterval bounds how often the appendlog
+// backend is compacted down to its latest entry.
+var compactInterval = flag.Duration("persist-compact-interval", defaultCompactInterval,
+	"how often the appendlog persistence backend is compacted")
+
+// windowSpec is a single parsed duration/resolution pair.
+// name is derived from duration via time.Duration.String,
+// not the raw flag token, so that equivalent-but-
+// differently-spelled durations (e.g. "1m" and "60s")
+// collide on the same window instead of being silently
+// treated as distinct ones.
+type windowSpec struct {
+	name       string
+	duration   time.Duration
+	resolution time.Duration
+}
+
+// parseWindows parses the "-windows" flag value into a
+// list of windowSpecs, smallest resolution first. Every
+// window's resolution must be an integer multiple of the
+// smallest (base tick) resolution in the set, since
+// windowCounter.tick rotates a bucket once
+// resolution/baseTick base ticks have elapsed; a
+// resolution that isn't an exact multiple would silently
+// truncate and miscount that window.
+func parseWindows(raw string) ([]windowSpec, error) {
+	var specs []windowSpec
+	for _, pair := range strings.Split(raw, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed window %q, want duration:resolution", pair)
+		}
+
+		duration, err := time.ParseDuration(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("window %q: %v", pair, err)
+		}
+
+		resolution, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("window %q: %v", pair, err)
+		}
+
+		if resolution <= 0 || duration <= 0 || duration%resolution != 0 {
+			return nil, fmt.Errorf("window %q: duration must be a positive multiple of resolution", pair)
+		}
+
+		specs = append(specs, windowSpec{name: duration.String(), duration: duration, resolution: resolution})
+	}
+
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("no windows configured")
+	}
+
+	sort.Slice(specs, func(i, j int) bool { return specs[i].resolution < specs[j].resolution })
+
+	baseTick := specs[0].resolution
+	for _, spec := range specs {
+		if spec.resolution%baseTick != 0 {
+			return nil, fmt.Errorf("window %q: resolution must be a multiple of the smallest configured resolution (%s)", spec.name, baseTick)
+		}
+	}
+
+	return specs, nil
+}
+
+// windowCounter is a ring buffer of per-bucket request
+// counts covering the last 'duration', at 'resolution'
+// granularity.
+type windowCounter struct {
+	name       string
+	duration   time.Duration
+	resolution time.Duration
+	// ticksPerBucket is the number of base ticks
+	// that make up one bucket of this window.
+	ticksPerBucket uint64
+	// ticksSinceRotate counts base ticks accumulated
+	// into 'accum' since the last bucket rotation.
+	ticksSinceRotate uint64
+	// accum is the request count building up for
+	// the bucket currently being filled.
+	accum uint64
+	// buckets stores one request count per resolution
+	// period over the last 'duration'.
+	buckets []uint64
+	// idx is the index of the oldest bucket, which is
+	// also the next bucket to be overwritten.
+	idx uint
+	// total is the sum of all buckets, i.e. the number
+	// of requests received in the last 'duration'.
+	total uint64
+	// filled is the number of buckets that have been
+	// rotated into at least once, capped at
+	// len(buckets). Buckets beyond this count are still
+	// zero-initialized placeholders rather than real
+	// measurements, and must be excluded from rate
+	// percentiles until the window has been running for
+	// a full 'duration'.
+	filled uint
+}
+
+// newWindowCounter creates a windowCounter for the
+// given spec, ticking at 'baseTick' granularity.
+func newWindowCounter(spec windowSpec, baseTick time.Duration) *windowCounter {
+	return &windowCounter{
+		name:           spec.name,
+		duration:       spec.duration,
+		resolution:     spec.resolution,
+		ticksPerBucket: uint64(spec.resolution / baseTick),
+		buckets:        make([]uint64, spec.duration/spec.resolution),
+	}
+}
+
+// tick folds 'n' requests received during the last base
+// tick into the bucket currently being filled, rotating
+// the ring once 'resolution' worth of ticks has elapsed.
+func (w *windowCounter) tick(n uint64) {
+	w.accum += n
+	w.ticksSinceRotate++
+	if w.ticksSinceRotate < w.ticksPerBucket {
+		return
+	}
+
+	w.total -= w.buckets[w.idx]
+	w.buckets[w.idx] = w.accum
+	w.total += w.accum
+
+	w.accum = 0
+	w.ticksSinceRotate = 0
+	w.idx = (w.idx + 1) % uint(len(w.buckets))
+	if w.filled < uint(len(w.buckets)) {
+		w.filled++
+	}
+}
+
+// rates returns the per-bucket request rate, in
+// requests per second, for every filled bucket. Buckets
+// the window hasn't rotated into yet are omitted, so
+// percentiles aren't diluted by zero-initialized
+// placeholders before the window has been running for a
+// full 'duration'.
+func (w *windowCounter) rates() []float64 {
+	rates := make([]float64, w.filled)
+	for i := uint(0); i < w.filled; i++ {
+		rates[i] = float64(w.buckets[i]) / w.resolution.Seconds()
+	}
+	return rates
+}
+
+// percentile returns the p-th percentile (0-100) of
+// the window's per-bucket rates, using nearest-rank.
+func percentile(rates []float64, p float64) float64 {
+	if len(rates) == 0 {
+		return 0
+	}
+
+	sorted := make([]float64, len(rates))
+	copy(sorted, rates)
+	sort.Float64s(sorted)
+
+	rank := int(p/100*float64(len(sorted))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// requestCounter keeps track of the number of requests
+// received, broken down over multiple sliding windows.
 type requestCounter struct {
 	// Mutex for set of consecutive operations
 	// on the request counter variables.
 	cntMutex sync.Mutex
-	// Number of requests received
-	// in a 'timeLapse' period.
-	timeLapseReqNo uint64
-	// Total number of requests received
-	// in a 'timeWindow' period.
-	timeWindowReqNo uint64
-	// Delta's index for 'deltas'.
-	deltaIdx uint
-	// Stores all the 'timeLapseReqNo'
-	// collected in a 'timeWindow' period.
-	deltas []uint64
+	// Number of requests received since the
+	// last base tick.
+	tickReqNo uint64
+	// One ring buffer per configured window,
+	// ordered by ascending resolution.
+	windows []*windowCounter
+	// persister durably stores the counter's state
+	// between runs and across restarts.
+	persister persist.Persister
 }
 
 // Request counter variable.
 var reqCnt requestCounter
 
-// Map containing the available resources.
-var mux map[string]func(http.ResponseWriter, *http.Request)
+// metricsReg backs the '/metrics' endpoint and, via
+// onRouteRequest, the primary window's request total,
+// so the two can never disagree.
+var metricsReg = metrics.NewRegistry(nil)
+
+// onRouteRequest feeds the primary window's sliding
+// window counter from the same measurement point used
+// to populate metricsReg.
+func onRouteRequest(route string, r *http.Request) {
+	if route == primaryWindowRoute {
+		reqCnt.increment()
+	}
+}
+
+// routeBytes tracks how many request body bytes each
+// route has consumed, keyed by pattern. Request counts
+// are tracked by metricsReg instead, so /stats and
+// /metrics never disagree on them.
+var routeBytes sync.Map // map[string]*uint64
+
+// recordRouteBytes adds n body bytes consumed by
+// pattern to its running total, so operators can see
+// how much bandwidth a streaming route consumes.
+func recordRouteBytes(pattern string, n int64) {
+	count, _ := routeBytes.LoadOrStore(pattern, new(uint64))
+	atomic.AddUint64(count.(*uint64), uint64(n))
+}
+
+// baseTick is the finest configured resolution; the
+// counter is updated once per baseTick.
+func baseTick(specs []windowSpec) time.Duration {
+	return specs[0].resolution
+}
 
 // Initialiase the data request counter structure.
-func (c *requestCounter) init() {
-	c.deltas = make([]uint64, 60)
-	c.loadFile()
+func (c *requestCounter) init(specs []windowSpec, p persist.Persister) {
+	tick := baseTick(specs)
+	c.windows = make([]*windowCounter, len(specs))
+	for i, spec := range specs {
+		c.windows[i] = newWindowCounter(spec, tick)
+	}
+	c.persister = p
+	c.load()
+}
+
+// windowByDuration returns the window configured with
+// the given duration, or nil if no such window is
+// configured. Matching on the parsed duration, rather
+// than a window's string name, means it's unaffected by
+// which equivalent spelling ("1m" vs "60s") an operator
+// used on the command line.
+func (c *requestCounter) windowByDuration(d time.Duration) *windowCounter {
+	for _, w := range c.windows {
+		if w.duration == d {
+			return w
+		}
+	}
+	return nil
 }
 
 // increment increments the amount of requests
-// received in a 'timeLapse' period.
+// received in the current base tick.
 func (c *requestCounter) increment() {
 	c.cntMutex.Lock()
-	c.timeLapseReqNo++
+	c.tickReqNo++
 	c.cntMutex.Unlock()
 }
 
-// abort logs a fatal message during any
-// operation related to the request count file.
-func abort(action string, err error) {
-	if err != nil {
-		log.Fatalln("Could not", action,
-			"the request count file:", err)
-	}
+// windowState is the on-disk representation of a
+// single window's ring buffer.
+type windowState struct {
+	Idx     uint
+	Buckets []uint64
+	Total   uint64
+	Filled  uint
 }
 
 // jsonData is a container for JSON data that have to
 // be written or read to or from the request data file.
 type jsonData struct {
-	DeltaIdx        uint
-	Deltas          []uint64
-	TimeWindowReqNo uint64
+	TickReqNo uint64
+	Windows   map[string]windowState
 }
 
-// loadFile loads the number of requests
-// from its relative file, if it exists.
-func (c *requestCounter) loadFile() {
-	if _, err := os.Stat(requestFile); err != nil {
+// load restores the counter's state from c.persister,
+// leaving the counter at zero if none has been saved
+// yet, and logging and leaving it at zero if the saved
+// state cannot be read back. A corrupt or unreadable persistence backend
+// must never prevent the server from starting.
+func (c *requestCounter) load() {
+	data, err := c.persister.Load()
+	if err != nil {
+		log.Println("counter: could not load persisted state, starting from zero:", err)
+		return
+	}
+	if data == nil {
+		return
+	}
+
+	var jsonData jsonData
+	if err := json.Unmarshal(data, &jsonData); err != nil {
+		log.Println("counter: could not decode persisted state, starting from zero:", err)
 		return
 	}
 
 	c.cntMutex.Lock()
 	defer c.cntMutex.Unlock()
 
-	data, err := os.Open(requestFile)
-	abort("open", err)
-
-	jsonData := jsonData{}
-	err = json.NewDecoder(data).Decode(&jsonData)
-	abort("JSON decode", err)
-
-	// Load the JSON data
-	c.deltaIdx = jsonData.DeltaIdx
-	copy(c.deltas, jsonData.Deltas)
-	atomic.StoreUint64(&c.timeWindowReqNo, jsonData.TimeWindowReqNo)
+	c.tickReqNo = jsonData.TickReqNo
+	for _, w := range c.windows {
+		state, ok := jsonData.Windows[w.name]
+		if !ok {
+			continue
+		}
+		w.idx = state.Idx
+		w.total = state.Total
+		w.filled = state.Filled
+		copy(w.buckets, state.Buckets)
+	}
 }
 
-// updateFile writes the number
-// of requests to a file.
-func (c *requestCounter) updateFile() {
+// save persists the counter's current state via
+// c.persister, retrying transient failures a few times
+// before giving up and logging, rather than crashing
+// the server the way a log.Fatalln from this
+// background path once did.
+func (c *requestCounter) save() {
 	c.cntMutex.Lock()
-	defer c.cntMutex.Unlock()
-
-	// Marshal the reqCnt into a JSON string
+	windowStates := make(map[string]windowState, len(c.windows))
+	for _, w := range c.windows {
+		buckets := make([]uint64, len(w.buckets))
+		copy(buckets, w.buckets)
+		windowStates[w.name] = windowState{
+			Idx:     w.idx,
+			Buckets: buckets,
+			Total:   w.total,
+			Filled:  w.filled,
+		}
+	}
 	jsonData := jsonData{
-		c.deltaIdx,
-		c.deltas,
-		c.timeWindowReqNo,
+		TickReqNo: c.tickReqNo,
+		Windows:   windowStates,
 	}
+	c.cntMutex.Unlock()
 
 	data, err := json.Marshal(jsonData)
-	abort("JSON encode", err)
-
-	err = ioutil.WriteFile(requestFile, data, 0644)
-	abort("update", err)
-}
-
-// handlerDispatcher routes a handler
-// request to its relative worker function.
-type handlerDispatcher struct{}
-
-func (*handlerDispatcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Call the registered handler, it it exists
-	if h, ok := mux[r.URL.String()]; ok {
-		h(w, r)
+	if err != nil {
+		log.Println("counter: could not encode state:", err)
 		return
 	}
 
-	// Default to 404 for non existing resources
-	w.WriteHeader(http.StatusNotFound)
-	fmt.Fprintf(w, "Requested resource '%s' does not exist\n",
-		html.EscapeString(r.URL.Path))
+	for attempt := 1; attempt <= maxPersistAttempts; attempt++ {
+		if err = c.persister.Save(data); err == nil {
+			return
+		}
+		log.Printf("counter: persist attempt %d/%d failed: %v", attempt, maxPersistAttempts, err)
+		if attempt < maxPersistAttempts {
+			time.Sleep(persistRetryBackoff)
+		}
+	}
+	log.Println("counter: giving up persisting state after", maxPersistAttempts, "attempts:", err)
 }
 
 // printRequestNo is the worker
 // function for the main hanlder.
 func printRequestNo(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
-	}
-
-	reqCnt.increment()
 	w.WriteHeader(http.StatusOK)
 
 	reqCnt.cntMutex.Lock()
-	fmt.Fprintf(w, "Served %d requests in the last : %s\n",
-		reqCnt.timeWindowReqNo+reqCnt.timeLapseReqNo, timeWindow)
+	primary := reqCnt.windowByDuration(primaryWindowDuration)
+	total := reqCnt.tickReqNo
+	if primary != nil {
+		total += primary.total
+	}
 	reqCnt.cntMutex.Unlock()
 
+	fmt.Fprintf(w, "Served %d requests in the last : %s\n",
+		total, primaryWindowDuration)
+
 	tm := time.Now().Format(time.RFC1123)
 	fmt.Fprintf(w, "The time is: %s\n", tm)
 }
 
-// updateTimeWindow updates and then reset the number
-// of requests received in a 'timeLapse' period,
+// statsWindow is the JSON shape of a single window's
+// entry in the '/stats' response.
+type statsWindow struct {
+	Duration string  `json:"duration"`
+	Total    uint64  `json:"total"`
+	P50      float64 `json:"p50"`
+	P95      float64 `json:"p95"`
+	P99      float64 `json:"p99"`
+}
+
+// statsRoute is the JSON shape of a single route's
+// entry in the '/stats' response.
+type statsRoute struct {
+	Count uint64 `json:"count"`
+	Bytes uint64 `json:"bytes"`
+}
+
+// statsResponse is the JSON shape of the '/stats'
+// response: per-window counts and rate percentiles,
+// plus per-route request and body-byte totals.
+type statsResponse struct {
+	Windows map[string]statsWindow `json:"windows"`
+	Routes  map[string]statsRoute  `json:"routes"`
+}
+
+// printStats is the worker function for the
+// '/stats' handler, reporting per-window counts,
+// per-bucket rate percentiles and per-route totals
+// as JSON.
+func printStats(w http.ResponseWriter, r *http.Request) {
+	reqCnt.cntMutex.Lock()
+	windows := make(map[string]statsWindow, len(reqCnt.windows))
+	for _, win := range reqCnt.windows {
+		rates := win.rates()
+		windows[win.name] = statsWindow{
+			Duration: win.duration.String(),
+			Total:    win.total,
+			P50:      percentile(rates, 50),
+			P95:      percentile(rates, 95),
+			P99:      percentile(rates, 99),
+		}
+	}
+	reqCnt.cntMutex.Unlock()
+
+	routes := make(map[string]statsRoute)
+	for pattern, count := range metricsReg.RequestsByRoute() {
+		routes[pattern] = statsRoute{Count: count}
+	}
+	routeBytes.Range(func(pattern, count interface{}) bool {
+		stat := routes[pattern.(string)]
+		stat.Bytes = atomic.LoadUint64(count.(*uint64))
+		routes[pattern.(string)] = stat
+		return true
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	stats := statsResponse{Windows: windows, Routes: routes}
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		log.Println("Could not encode stats response:", err)
+	}
+}
+
+// ingestHandler is the worker function for the
+// '/ingest' handler. It decodes the request body one
+// line at a time via stream.StreamLines, rather than
+// buffering it in full, so memory use does not grow
+// with the number of records; the body itself is capped
+// at maxRequestBytes.
+func ingestHandler(w http.ResponseWriter, r *http.Request) {
+	var lines uint64
+	n, err := stream.StreamLines(r, *maxRequestBytes, func(line []byte) error {
+		if len(line) > 0 {
+			lines++
+		}
+		return nil
+	})
+	recordRouteBytes("/ingest", n)
+
+	if err != nil {
+		if _, ok := err.(*stream.ErrTooLarge); ok {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		fmt.Fprintf(w, "Could not ingest request body: %v\n", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Ingested %d lines (%d bytes)\n", lines, n)
+}
+
+// printMetrics is the worker function for the
+// '/metrics' handler, exposing metricsReg in
+// Prometheus text exposition format.
+func printMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	if err := metricsReg.WritePrometheus(w); err != nil {
+		log.Println("Could not write metrics response:", err)
+	}
+}
+
+// updateTimeWindow folds the requests received during
+// the last base tick into every configured window.
 func (c *requestCounter) updateTimeWindow() {
 	// Using a mutex avoids race conditions
 	// that might arise getting and setting
 	// the request counter's values.
 	c.cntMutex.Lock()
 
-	if float64(c.deltaIdx) == timeWindow.Seconds() {
-		c.deltaIdx = 0
+	n := c.tickReqNo
+	c.tickReqNo = 0
+	for _, win := range c.windows {
+		win.tick(n)
 	}
 
-	// Total requests = (total requests - previous delta) + new delta
-	c.timeWindowReqNo -= c.deltas[c.deltaIdx]
-	c.timeWindowReqNo += c.timeLapseReqNo
-
-	// Store the new delta
-	c.deltas[c.deltaIdx] = c.timeLapseReqNo
-	c.timeLapseReqNo = 0
-
-	c.deltaIdx++
 	c.cntMutex.Unlock()
 }
 
-// updateTimeWindow runs every 'timeLapse'
-// seconds and stores the amount of request
-// received in 'timeLapse' seconds.
-func updateRequestCounter() {
+// updateRequestCounter runs every base tick and folds
+// the requests received into every window. Flushing
+// counter state to disk runs on its own, independent
+// schedule; see persistPeriodically.
+func updateRequestCounter(tick time.Duration) {
 	for {
-		time.Sleep(timeLapse)
+		time.Sleep(tick)
 		reqCnt.updateTimeWindow()
-		reqCnt.updateFile()
 	}
 }
 
-// handleSigInt is a handler for SIGINT.
-func handleSingInt(c <-chan os.Signal) {
+// persistPeriodically flushes the counter's state to
+// disk every interval, decoupled from the tick
+// resolution so counters can update every second while
+// flushes happen far less often.
+func persistPeriodically(interval time.Duration) {
 	for {
-		// TODO:
-		// Check that 'updateRequestCounter' has been run
-		// for the current second, otherwise we loose the
-		// current number of new requests.
-		sig := <-c
-		if sig == os.Interrupt {
-			reqCnt.updateFile()
+		time.Sleep(interval)
+		reqCnt.save()
+	}
+}
+
+// compactPeriodically compacts p's append-only log
+// down to its latest entry every interval.
+func compactPeriodically(p *persist.AppendLogPersister, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := p.Compact(); err != nil {
+			log.Println("counter: could not compact persistence log:", err)
+		}
+	}
+}
+
+// handleSignals drains SIGINT/SIGTERM into a graceful
+// shutdown, and SIGHUP into a zero-downtime restart.
+func handleSignals(c <-chan os.Signal, gs *graceful.Server) {
+	for sig := range c {
+		switch sig {
+		case os.Interrupt, syscall.SIGTERM:
 			log.Println("Stopping server...")
-			// NOTE:
-			// The effective exit code is 1,
-			// instead of 0, this is due to
-			// a bug in Go signal handling.
-			os.Exit(0)
+			if err := gs.Shutdown(); err != nil {
+				log.Println("Graceful shutdown error:", err)
+			}
+			return
+
+		case syscall.SIGHUP:
+			log.Println("Restarting server...")
+			if err := gs.Restart(); err != nil {
+				log.Println("Restart failed, continuing to serve:", err)
+				continue
+			}
+			return
 		}
 	}
 }
 
 func main() {
+	flag.Parse()
+
+	specs, err := parseWindows(*windows)
+	if err != nil {
+		log.Fatalln("Invalid -windows flag:", err)
+	}
+
 	log.Println("Launching server")
+	mux := router.NewServer()
+	mux.Use(metrics.Middleware(metricsReg, onRouteRequest))
+	mux.HandleFunc("/", printRequestNo, http.MethodGet)
+	mux.HandleFunc("/stats", printStats, http.MethodGet)
+	mux.HandleFunc("/ingest", ingestHandler, http.MethodPost)
+	mux.HandleFunc("/metrics", printMetrics, http.MethodGet)
+
 	server := http.Server{
-		Addr:           connPort,
-		Handler:        &handlerDispatcher{},
+		Handler:        mux,
 		ReadTimeout:    10 * time.Second,
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
-	// List of request handlers
-	mux = make(map[string]func(http.ResponseWriter, *http.Request))
-	mux["/"] = printRequestNo
 
-	reqCnt.init()
-	go updateRequestCounter()
+	var persister persist.Persister
+	switch *persistBackend {
+	case "file":
+		persister = persist.NewFilePersister(requestFile)
+	case "appendlog":
+		appendLog := persist.NewAppendLogPersister(requestFile)
+		go compactPeriodically(appendLog, *compactInterval)
+		persister = appendLog
+	default:
+		log.Fatalln("Invalid -persist-backend:", *persistBackend)
+	}
+
+	reqCnt.init(specs, persister)
+	go updateRequestCounter(baseTick(specs))
+	go persistPeriodically(*persistInterval)
 
-	// Handle SIGINT
+	gs := graceful.NewServer(&server, *shutdownTimeout)
+	gs.OnPreShutdown(reqCnt.save)
+	gs.OnPostRestart(reqCnt.load)
+
+	// Handle SIGINT/SIGTERM (graceful shutdown) and
+	// SIGHUP (zero-downtime restart).
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	go handleSingInt(c)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	drained := make(chan struct{})
+	go func() {
+		handleSignals(c, gs)
+		close(drained)
+	}()
 
 	log.Println("Listening...")
 	log.Println("Type CTRL-C to stop the server")
-	log.Fatalln("Server Close Error - ", server.ListenAndServe())
+	if err := gs.ListenAndServe(connPort); err != nil && err != http.ErrServerClosed {
+		log.Fatalln("Server Close Error - ", err)
+	}
+	// Serve returns as soon as a shutdown starts; wait
+	// for the drain to finish before exiting.
+	<-drained
 }
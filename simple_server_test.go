@@ -0,0 +1,139 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestWindowCounterTickSubBucket checks that a window
+// only rotates a bucket once a full resolution's worth
+// of base ticks has accumulated into it, rather than on
+// every base tick.
+func TestWindowCounterTickSubBucket(t *testing.T) {
+	spec := windowSpec{name: "test", duration: 4 * time.Second, resolution: 2 * time.Second}
+	w := newWindowCounter(spec, time.Second)
+
+	w.tick(1) // first base tick of the bucket: accumulate, no rotation yet
+	if w.total != 0 || w.buckets[0] != 0 {
+		t.Fatalf("expected no rotation after a partial bucket, got total=%d buckets=%v", w.total, w.buckets)
+	}
+
+	w.tick(1) // second base tick completes the bucket: rotate
+	if w.total != 2 || w.buckets[0] != 2 || w.idx != 1 {
+		t.Fatalf("expected rotation with total=2 after a full bucket, got total=%d buckets=%v idx=%d", w.total, w.buckets, w.idx)
+	}
+}
+
+// TestWindowCounterTickEviction advances a window across
+// a full trip of its ring buffer and checks that the
+// oldest bucket's count is evicted from the running total
+// once the ring wraps back around to it.
+func TestWindowCounterTickEviction(t *testing.T) {
+	spec := windowSpec{name: "test", duration: 4 * time.Second, resolution: time.Second}
+	w := newWindowCounter(spec, time.Second) // ticksPerBucket == 1: one tick rotates one bucket
+
+	for i, n := range []uint64{1, 2, 3, 4} {
+		w.tick(n)
+		if w.buckets[i] != n {
+			t.Fatalf("tick %d: expected buckets[%d]=%d, got %d", i, i, n, w.buckets[i])
+		}
+	}
+	if w.total != 10 || w.idx != 0 {
+		t.Fatalf("expected total=10 idx=0 after filling the ring, got total=%d idx=%d", w.total, w.idx)
+	}
+
+	w.tick(5) // wraps back to bucket 0, evicting its old count of 1
+	if w.total != 14 {
+		t.Fatalf("expected total=14 after evicting bucket 0 (10-1+5), got %d", w.total)
+	}
+	if w.buckets[0] != 5 || w.idx != 1 {
+		t.Fatalf("expected buckets[0]=5 idx=1 after wrap, got buckets[0]=%d idx=%d", w.buckets[0], w.idx)
+	}
+}
+
+// TestWindowCounterRatesExcludesUnfilled checks that
+// rates() omits buckets the window hasn't rotated into
+// yet, so a window that hasn't been running for a full
+// 'duration' doesn't dilute percentiles with zeros.
+func TestWindowCounterRatesExcludesUnfilled(t *testing.T) {
+	spec := windowSpec{name: "test", duration: 4 * time.Second, resolution: time.Second}
+	w := newWindowCounter(spec, time.Second)
+
+	w.tick(2)
+	w.tick(4)
+
+	rates := w.rates()
+	want := []float64{2, 4}
+	if len(rates) != len(want) {
+		t.Fatalf("rates() = %v, want %v", rates, want)
+	}
+	for i := range want {
+		if rates[i] != want[i] {
+			t.Fatalf("rates() = %v, want %v", rates, want)
+		}
+	}
+
+	for i := 0; i < len(w.buckets)-2; i++ {
+		w.tick(0)
+	}
+	if got := len(w.rates()); got != len(w.buckets) {
+		t.Fatalf("rates() returned %d entries after filling the ring, want %d", got, len(w.buckets))
+	}
+}
+
+// TestParseWindowsNormalizesName checks that equivalent
+// but differently-spelled durations (e.g. "1m" and "60s")
+// produce the same window name, so they collide on the
+// same window instead of being silently treated as
+// distinct ones.
+func TestParseWindowsNormalizesName(t *testing.T) {
+	specs, err := parseWindows("60s:1s")
+	if err != nil {
+		t.Fatalf("parseWindows returned error: %v", err)
+	}
+	if len(specs) != 1 {
+		t.Fatalf("parseWindows(\"60s:1s\") = %v, want 1 spec", specs)
+	}
+	if want := time.Minute.String(); specs[0].name != want {
+		t.Errorf("spec name = %q, want %q", specs[0].name, want)
+	}
+}
+
+// TestParseWindowsRejectsNonMultipleResolution checks
+// that a window whose resolution isn't an integer
+// multiple of the smallest configured resolution (the
+// base tick) is rejected, rather than silently truncated
+// by windowCounter's ticksPerBucket computation.
+func TestParseWindowsRejectsNonMultipleResolution(t *testing.T) {
+	if _, err := parseWindows("1m:2s,1m:3s"); err == nil {
+		t.Fatal("parseWindows(\"1m:2s,1m:3s\") = nil error, want an error")
+	}
+}
+
+// TestPercentile checks nearest-rank percentiles against
+// a known, already-sorted set of rates.
+func TestPercentile(t *testing.T) {
+	rates := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+
+	cases := []struct {
+		p    float64
+		want float64
+	}{
+		{50, 5},
+		{95, 9},
+		{99, 9},
+	}
+	for _, c := range cases {
+		if got := percentile(rates, c.p); got != c.want {
+			t.Errorf("percentile(rates, %v) = %v, want %v", c.p, got, c.want)
+		}
+	}
+}
+
+// TestPercentileEmpty checks that an empty rate set
+// doesn't panic and reports a zero percentile.
+func TestPercentileEmpty(t *testing.T) {
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("percentile(nil, 50) = %v, want 0", got)
+	}
+}
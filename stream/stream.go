@@ -0,0 +1,100 @@
+// Package stream provides helpers for decoding large
+// request bodies incrementally, rather than buffering
+// them in full, so a single request can carry an
+// arbitrarily large array or line stream without
+// holding it all in memory at once.
+package stream
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ErrTooLarge is returned when a request body exceeds
+// the maxBytes passed to StreamJSON or StreamLines.
+type ErrTooLarge struct {
+	MaxBytes int64
+}
+
+func (e *ErrTooLarge) Error() string {
+	return fmt.Sprintf("stream: request body exceeds the %d byte limit", e.MaxBytes)
+}
+
+// countingReader wraps r, tracking how many bytes
+// have been read from it so far.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// StreamJSON decodes r's body as a top-level JSON
+// array, invoking fn with each element in turn without
+// holding the whole array in memory. It returns the
+// number of bytes read, and an *ErrTooLarge error if
+// the body would exceed maxBytes.
+func StreamJSON(r *http.Request, maxBytes int64, fn func(msg json.RawMessage) error) (int64, error) {
+	cr := &countingReader{r: io.LimitReader(r.Body, maxBytes+1)}
+	dec := json.NewDecoder(cr)
+
+	tok, err := dec.Token()
+	if err != nil {
+		return cr.n, err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return cr.n, fmt.Errorf("stream: expected a JSON array")
+	}
+
+	for dec.More() {
+		if cr.n > maxBytes {
+			return cr.n, &ErrTooLarge{MaxBytes: maxBytes}
+		}
+
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			if cr.n > maxBytes {
+				return cr.n, &ErrTooLarge{MaxBytes: maxBytes}
+			}
+			return cr.n, err
+		}
+		if err := fn(raw); err != nil {
+			return cr.n, err
+		}
+	}
+
+	_, err = dec.Token() // consume the closing ']'
+	if cr.n > maxBytes {
+		return cr.n, &ErrTooLarge{MaxBytes: maxBytes}
+	}
+	return cr.n, err
+}
+
+// StreamLines invokes fn with each newline-delimited
+// line of r's body in turn, without holding the whole
+// body in memory. It returns the number of bytes read,
+// and an *ErrTooLarge error if the body would exceed
+// maxBytes.
+func StreamLines(r *http.Request, maxBytes int64, fn func(line []byte) error) (int64, error) {
+	cr := &countingReader{r: io.LimitReader(r.Body, maxBytes+1)}
+	scanner := bufio.NewScanner(cr)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		if cr.n > maxBytes {
+			return cr.n, &ErrTooLarge{MaxBytes: maxBytes}
+		}
+		if err := fn(scanner.Bytes()); err != nil {
+			return cr.n, err
+		}
+	}
+
+	return cr.n, scanner.Err()
+}